@@ -0,0 +1,108 @@
+// +build linux
+
+// Package arpprobe checks whether a candidate DHCP lease address is
+// already in use on the segment before it is offered, per RFC 2131
+// section 4 and RFC 5227.
+package arpprobe
+
+import (
+	"net"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// DefaultTimeout is how long Probe waits for an ARP reply before deciding
+// the address is free.
+const DefaultTimeout = 200 * time.Millisecond
+
+// Prober sends ARP requests for a candidate address over a live pcap
+// handle and reports whether anyone on the segment answers.
+type Prober struct {
+	handle  *pcap.Handle
+	srcMac  net.HardwareAddr
+	timeout time.Duration
+	packets <-chan gopacket.Packet
+}
+
+// New opens its own live capture handle on ifName, filtered to ARP
+// traffic, and returns a Prober that sends probes over it. The prober
+// deliberately does not share a handle with the server's DHCP transport:
+// that handle is filtered to UDP/67 and would never see ARP replies, and
+// reading it from two goroutines would race with the server's own
+// receive loop.
+func New(ifName string, srcMac net.HardwareAddr) (*Prober, error) {
+	handle, err := pcap.OpenLive(ifName, 1600, true, DefaultTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := handle.SetBPFFilter("arp"); err != nil {
+		handle.Close()
+		return nil, err
+	}
+	return &Prober{
+		handle:  handle,
+		srcMac:  srcMac,
+		timeout: DefaultTimeout,
+		packets: gopacket.NewPacketSource(handle, handle.LinkType()).Packets(),
+	}, nil
+}
+
+// SetTimeout overrides DefaultTimeout.
+func (p *Prober) SetTimeout(timeout time.Duration) *Prober {
+	p.timeout = timeout
+	return p
+}
+
+// Probe sends an ARP request for ip with SourceProtAddress 0.0.0.0 and
+// reports whether a reply was observed within the configured timeout,
+// meaning the address is already in use. It reads from the Prober's own
+// long-lived packet source rather than opening a new one per call:
+// gopacket.PacketSource.Packets() starts a goroutine that runs for the
+// life of the handle, so building one per probe leaked a goroutine (and
+// a concurrent reader of the handle) on every DHCPDISCOVER.
+func (p *Prober) Probe(ip net.IP) (bool, error) {
+	if err := p.handle.WritePacketData(p.buildRequest(ip)); err != nil {
+		return false, err
+	}
+	deadline := time.After(p.timeout)
+	for {
+		select {
+		case packet := <-p.packets:
+			arpLayer := packet.Layer(layers.LayerTypeARP)
+			if arpLayer == nil {
+				continue
+			}
+			arp := arpLayer.(*layers.ARP)
+			if arp.Operation == layers.ARPReply && net.IP(arp.SourceProtAddress).Equal(ip) {
+				return true, nil
+			}
+		case <-deadline:
+			return false, nil
+		}
+	}
+}
+
+func (p *Prober) buildRequest(ip net.IP) []byte {
+	eth := &layers.Ethernet{
+		SrcMAC:       p.srcMac,
+		DstMAC:       net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		EthernetType: layers.EthernetTypeARP,
+	}
+	arp := &layers.ARP{
+		AddrType:          layers.LinkTypeEthernet,
+		Protocol:          layers.EthernetTypeIPv4,
+		HwAddressSize:     6,
+		ProtAddressSize:   4,
+		Operation:         layers.ARPRequest,
+		SourceHwAddress:   p.srcMac,
+		SourceProtAddress: net.IPv4zero.To4(),
+		DstHwAddress:      net.HardwareAddr{0, 0, 0, 0, 0, 0},
+		DstProtAddress:    ip.To4(),
+	}
+	buf := gopacket.NewSerializeBuffer()
+	gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, eth, arp)
+	return buf.Bytes()
+}
@@ -0,0 +1,213 @@
+package leases
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var leasesBucket = []byte("leases")
+var conflictsBucket = []byte("conflicts")
+
+// BoltStore persists leases in a BoltDB file, one key per MAC address.
+// Unlike JSONStore it does not keep a full in-memory copy between calls,
+// so it is the store to reach for once a pool is too large to comfortably
+// rewrite on every Save.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// NewBoltStore opens (creating if necessary) the BoltDB file at path and
+// returns a store backed by it. The caller is responsible for closing the
+// returned store's underlying *bolt.DB, through Close, when the server
+// shuts down.
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(leasesBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(conflictsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+// Close closes the underlying *bolt.DB.
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *BoltStore) Allocate(mac net.HardwareAddr, requested net.IP, vlan []uint16) (*Lease, error) {
+	lease := &Lease{Mac: mac, Ip: requested, VLan: vlan, Expiry: time.Now().Add(LeaseTime)}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(leasesBucket)
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if string(k) == mac.String() {
+				continue
+			}
+			var other Lease
+			if err := json.Unmarshal(v, &other); err != nil {
+				return err
+			}
+			if other.Ip.Equal(requested) && time.Now().Before(other.Expiry) {
+				return fmt.Errorf("address %s is already leased to %s", requested, other.Mac)
+			}
+		}
+		data, err := json.Marshal(lease)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(mac.String()), data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return lease, nil
+}
+
+func (s *BoltStore) Renew(mac net.HardwareAddr, ip net.IP) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(leasesBucket)
+		data := b.Get([]byte(mac.String()))
+		if data == nil {
+			return fmt.Errorf("no lease for %s on %s", mac, ip)
+		}
+		var lease Lease
+		if err := json.Unmarshal(data, &lease); err != nil {
+			return err
+		}
+		if !lease.Ip.Equal(ip) {
+			return fmt.Errorf("no lease for %s on %s", mac, ip)
+		}
+		lease.Expiry = time.Now().Add(LeaseTime)
+		updated, err := json.Marshal(lease)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(mac.String()), updated)
+	})
+}
+
+func (s *BoltStore) Release(mac net.HardwareAddr, ip net.IP) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(leasesBucket)
+		data := b.Get([]byte(mac.String()))
+		if data == nil {
+			return fmt.Errorf("no lease for %s on %s", mac, ip)
+		}
+		var lease Lease
+		if err := json.Unmarshal(data, &lease); err != nil {
+			return err
+		}
+		if !lease.Ip.Equal(ip) {
+			return fmt.Errorf("no lease for %s on %s", mac, ip)
+		}
+		return b.Delete([]byte(mac.String()))
+	})
+}
+
+func (s *BoltStore) Expired(now time.Time) []Lease {
+	var expired []Lease
+	s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(leasesBucket)
+		c := b.Cursor()
+		var stale [][]byte
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var lease Lease
+			if err := json.Unmarshal(v, &lease); err != nil {
+				continue
+			}
+			if now.After(lease.Expiry) {
+				expired = append(expired, lease)
+				stale = append(stale, append([]byte(nil), k...))
+			}
+		}
+		for _, k := range stale {
+			b.Delete(k)
+		}
+		return nil
+	})
+	return expired
+}
+
+func (s *BoltStore) All() []Lease {
+	var all []Lease
+	s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(leasesBucket).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var lease Lease
+			if err := json.Unmarshal(v, &lease); err != nil {
+				continue
+			}
+			all = append(all, lease)
+		}
+		return nil
+	})
+	return all
+}
+
+func (s *BoltStore) Conflict(ip net.IP, quarantine time.Duration) {
+	s.db.Update(func(tx *bolt.Tx) error {
+		until, err := time.Now().Add(quarantine).MarshalBinary()
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(conflictsBucket).Put([]byte(ip.String()), until)
+	})
+}
+
+func (s *BoltStore) IsConflicted(ip net.IP) bool {
+	var conflicted bool
+	s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(conflictsBucket).Get([]byte(ip.String()))
+		if data == nil {
+			return nil
+		}
+		var until time.Time
+		if err := until.UnmarshalBinary(data); err != nil {
+			return err
+		}
+		conflicted = time.Now().Before(until)
+		return nil
+	})
+	return conflicted
+}
+
+// ReapConflicts purges conflictsBucket entries whose quarantine window
+// has already elapsed, so it doesn't grow without bound over the
+// server's lifetime on a segment with routine conflicts.
+func (s *BoltStore) ReapConflicts(now time.Time) {
+	s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(conflictsBucket)
+		c := b.Cursor()
+		var stale [][]byte
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var until time.Time
+			if err := until.UnmarshalBinary(v); err != nil {
+				continue
+			}
+			if now.After(until) {
+				stale = append(stale, append([]byte(nil), k...))
+			}
+		}
+		for _, k := range stale {
+			b.Delete(k)
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) Load() error { return nil }
+func (s *BoltStore) Save() error { return nil }
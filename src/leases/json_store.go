@@ -0,0 +1,48 @@
+package leases
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+)
+
+// JSONStore persists leases to a single JSON file on disk, read in full
+// on Load and rewritten in full on Save. It is meant for small
+// deployments; BoltStore scales better for large pools.
+type JSONStore struct {
+	*MemoryStore
+	path string
+}
+
+// NewJSONStore returns a JSONStore backed by path. Load must be called
+// to populate it from an existing file.
+func NewJSONStore(path string) *JSONStore {
+	return &JSONStore{MemoryStore: NewMemoryStore(), path: path}
+}
+
+func (s *JSONStore) Load() error {
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var leases map[string]*Lease
+	if err := json.Unmarshal(data, &leases); err != nil {
+		return err
+	}
+	s.leases = leases
+	return nil
+}
+
+func (s *JSONStore) Save() error {
+	s.mu.Lock()
+	data, err := json.Marshal(s.leases)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.path, data, 0644)
+}
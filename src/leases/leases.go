@@ -0,0 +1,158 @@
+// Package leases implements pluggable lease persistence for the DHCP
+// server: tracking which client holds which address, across allocation,
+// renewal, release, and expiry, and (for the on-disk implementations)
+// across server restarts.
+package leases
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Lease records the outcome of an allocation: the client that holds an
+// address, on which VLAN(s), and until when.
+type Lease struct {
+	Mac    net.HardwareAddr
+	Ip     net.IP
+	VLan   []uint16
+	Expiry time.Time
+}
+
+// LeaseStore tracks address allocations so the pool can be reclaimed on
+// expiry and, for persistent implementations, restored after a restart.
+type LeaseStore interface {
+	Allocate(mac net.HardwareAddr, requested net.IP, vlan []uint16) (*Lease, error)
+	Renew(mac net.HardwareAddr, ip net.IP) error
+	Release(mac net.HardwareAddr, ip net.IP) error
+	Expired(now time.Time) []Lease
+	All() []Lease
+	Conflict(ip net.IP, quarantine time.Duration)
+	IsConflicted(ip net.IP) bool
+	ReapConflicts(now time.Time)
+	Load() error
+	Save() error
+}
+
+// LeaseTime is the duration a freshly allocated or renewed lease is valid
+// for, before it becomes eligible for expiry reaping.
+var LeaseTime = 24 * time.Hour
+
+// ConflictQuarantine is how long an address found to be in conflict (a
+// DHCPDECLINE, or a failed ARP probe) is withheld from future offers.
+var ConflictQuarantine = 10 * time.Minute
+
+// MemoryStore is a LeaseStore that keeps all state in memory. Load and
+// Save are no-ops; it does not survive a restart on its own, but other
+// stores embed it to get the bookkeeping for free.
+type MemoryStore struct {
+	mu        sync.Mutex
+	leases    map[string]*Lease
+	conflicts map[string]time.Time
+}
+
+// NewMemoryStore returns an empty, ready to use MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{leases: make(map[string]*Lease), conflicts: make(map[string]time.Time)}
+}
+
+func (s *MemoryStore) Allocate(mac net.HardwareAddr, requested net.IP, vlan []uint16) (*Lease, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := mac.String()
+	for other, lease := range s.leases {
+		if other != key && lease.Ip.Equal(requested) && time.Now().Before(lease.Expiry) {
+			return nil, fmt.Errorf("address %s is already leased to %s", requested, lease.Mac)
+		}
+	}
+	lease := &Lease{
+		Mac:    mac,
+		Ip:     requested,
+		VLan:   vlan,
+		Expiry: time.Now().Add(LeaseTime),
+	}
+	s.leases[key] = lease
+	return lease, nil
+}
+
+func (s *MemoryStore) Renew(mac net.HardwareAddr, ip net.IP) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lease, ok := s.leases[mac.String()]
+	if !ok || !lease.Ip.Equal(ip) {
+		return fmt.Errorf("no lease for %s on %s", mac, ip)
+	}
+	lease.Expiry = time.Now().Add(LeaseTime)
+	return nil
+}
+
+func (s *MemoryStore) Release(mac net.HardwareAddr, ip net.IP) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := mac.String()
+	lease, ok := s.leases[key]
+	if !ok || !lease.Ip.Equal(ip) {
+		return fmt.Errorf("no lease for %s on %s", mac, ip)
+	}
+	delete(s.leases, key)
+	return nil
+}
+
+func (s *MemoryStore) Expired(now time.Time) []Lease {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var expired []Lease
+	for key, lease := range s.leases {
+		if now.After(lease.Expiry) {
+			expired = append(expired, *lease)
+			delete(s.leases, key)
+		}
+	}
+	return expired
+}
+
+// All returns every currently held lease, for the management API's
+// GET /leases.
+func (s *MemoryStore) All() []Lease {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	all := make([]Lease, 0, len(s.leases))
+	for _, lease := range s.leases {
+		all = append(all, *lease)
+	}
+	return all
+}
+
+// Conflict marks ip as withheld from future offers until quarantine
+// elapses.
+func (s *MemoryStore) Conflict(ip net.IP, quarantine time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conflicts[ip.String()] = time.Now().Add(quarantine)
+}
+
+// IsConflicted reports whether ip is currently withheld by a prior
+// Conflict call.
+func (s *MemoryStore) IsConflicted(ip net.IP) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	until, ok := s.conflicts[ip.String()]
+	return ok && time.Now().Before(until)
+}
+
+// ReapConflicts purges quarantine entries whose window has already
+// elapsed, so the conflicts map doesn't grow without bound over the
+// server's lifetime on a segment with routine conflicts.
+func (s *MemoryStore) ReapConflicts(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ip, until := range s.conflicts {
+		if now.After(until) {
+			delete(s.conflicts, ip)
+		}
+	}
+}
+
+func (s *MemoryStore) Load() error { return nil }
+func (s *MemoryStore) Save() error { return nil }
@@ -0,0 +1,79 @@
+package leases
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func mac(s string) net.HardwareAddr {
+	m, err := net.ParseMAC(s)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+func TestAllocateConflictWithRequestedIp(t *testing.T) {
+	store := NewMemoryStore()
+	ip := net.IPv4(192, 168, 1, 10)
+	if _, err := store.Allocate(mac("00:11:22:33:44:55"), ip, nil); err != nil {
+		t.Fatalf("first allocation failed: %s", err)
+	}
+	if _, err := store.Allocate(mac("00:11:22:33:44:66"), ip, nil); err == nil {
+		t.Fatal("expected conflict when a second client requests an already-leased address")
+	}
+}
+
+func TestAllReturnsHeldLeases(t *testing.T) {
+	store := NewMemoryStore()
+	store.Allocate(mac("00:11:22:33:44:55"), net.IPv4(192, 168, 1, 10), nil)
+	store.Allocate(mac("00:11:22:33:44:66"), net.IPv4(192, 168, 1, 11), nil)
+	all := store.All()
+	if len(all) != 2 {
+		t.Fatalf("expected 2 leases, got %d", len(all))
+	}
+}
+
+func TestConflictQuarantinesAddress(t *testing.T) {
+	store := NewMemoryStore()
+	ip := net.IPv4(192, 168, 1, 20)
+	if store.IsConflicted(ip) {
+		t.Fatal("address should not be conflicted before Conflict is called")
+	}
+	store.Conflict(ip, time.Minute)
+	if !store.IsConflicted(ip) {
+		t.Fatal("expected address to be conflicted")
+	}
+}
+
+func TestReapConflictsPurgesElapsedQuarantine(t *testing.T) {
+	store := NewMemoryStore()
+	ip := net.IPv4(192, 168, 1, 21)
+	store.Conflict(ip, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	store.ReapConflicts(time.Now())
+	store.mu.Lock()
+	_, stillPresent := store.conflicts[ip.String()]
+	store.mu.Unlock()
+	if stillPresent {
+		t.Fatal("expected elapsed conflict entry to be reaped")
+	}
+}
+
+func TestExpiredReapsStaleLeases(t *testing.T) {
+	store := NewMemoryStore()
+	LeaseTime = time.Millisecond
+	defer func() { LeaseTime = 24 * time.Hour }()
+	if _, err := store.Allocate(mac("00:11:22:33:44:55"), net.IPv4(192, 168, 1, 10), nil); err != nil {
+		t.Fatalf("allocation failed: %s", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	expired := store.Expired(time.Now())
+	if len(expired) != 1 {
+		t.Fatalf("expected 1 expired lease, got %d", len(expired))
+	}
+	if len(store.Expired(time.Now())) != 0 {
+		t.Fatal("expired lease should have been reaped, not reported twice")
+	}
+}
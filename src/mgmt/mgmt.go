@@ -0,0 +1,127 @@
+// Package mgmt is the HTTP/JSON management surface for the DHCP server:
+// lease listing and forced release, live configuration reload, and
+// Prometheus metrics, in the spirit of AdGuardHome's dhcpd HTTP API.
+package mgmt
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"server"
+	"strings"
+
+	"leases"
+)
+
+// LeaseStore is the subset of leases.LeaseStore the management API needs.
+type LeaseStore interface {
+	All() []leases.Lease
+	Release(mac net.HardwareAddr, ip net.IP) error
+}
+
+// Reloader re-reads configuration and atomically swaps in the resulting
+// resolver, for POST /config/reload.
+type Reloader interface {
+	Reload() error
+}
+
+// Counters exposes a counter snapshot for GET /metrics.
+type Counters interface {
+	CounterSnapshot() []server.CounterSample
+}
+
+// Server is the management HTTP API. Any of LeaseStore, Reloader, or
+// Counters may be left nil. With no Reloader, POST /config/reload and
+// with no LeaseStore, DELETE /leases/{mac} reply 501 Not Implemented;
+// with no LeaseStore, GET /leases replies with an empty list, and with no
+// Counters, GET /metrics replies with an empty body.
+type Server struct {
+	Addr       string
+	LeaseStore LeaseStore
+	Reloader   Reloader
+	Counters   Counters
+}
+
+// ListenAndServe starts the management API on Addr. It blocks, like
+// http.ListenAndServe.
+func (s *Server) ListenAndServe() error {
+	return http.ListenAndServe(s.Addr, s.Handler())
+}
+
+// Handler builds the management API's http.Handler, for tests and for
+// embedding behind another listener.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/leases", s.handleLeases)
+	mux.HandleFunc("/leases/", s.handleLeaseByMac)
+	mux.HandleFunc("/config/reload", s.handleReload)
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	return mux
+}
+
+func (s *Server) handleLeases(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.LeaseStore == nil {
+		json.NewEncoder(w).Encode([]leases.Lease{})
+		return
+	}
+	json.NewEncoder(w).Encode(s.LeaseStore.All())
+}
+
+func (s *Server) handleLeaseByMac(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.LeaseStore == nil {
+		http.Error(w, "no lease store configured", http.StatusNotImplemented)
+		return
+	}
+	mac, err := net.ParseMAC(strings.TrimPrefix(r.URL.Path, "/leases/"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid mac address: %s", err), http.StatusBadRequest)
+		return
+	}
+	for _, lease := range s.LeaseStore.All() {
+		if lease.Mac.String() != mac.String() {
+			continue
+		}
+		if err := s.LeaseStore.Release(mac, lease.Ip); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	http.Error(w, "no lease held by that mac address", http.StatusNotFound)
+}
+
+func (s *Server) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.Reloader == nil {
+		http.Error(w, "no reloader configured", http.StatusNotImplemented)
+		return
+	}
+	if err := s.Reloader.Reload(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if s.Counters == nil {
+		return
+	}
+	for _, sample := range s.Counters.CounterSnapshot() {
+		fmt.Fprintf(w, "dhcp_packets_total{type=%q,interface=%q,vlan=%q} %d\n",
+			sample.MsgType, sample.Interface, sample.VLan, sample.Count)
+	}
+}
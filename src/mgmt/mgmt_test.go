@@ -0,0 +1,113 @@
+package mgmt
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"leases"
+	"server"
+)
+
+type fakeLeaseStore struct {
+	leases   []leases.Lease
+	released []string
+}
+
+func (f *fakeLeaseStore) All() []leases.Lease { return f.leases }
+
+func (f *fakeLeaseStore) Release(mac net.HardwareAddr, ip net.IP) error {
+	f.released = append(f.released, mac.String())
+	return nil
+}
+
+type fakeReloader struct {
+	called bool
+}
+
+func (f *fakeReloader) Reload() error {
+	f.called = true
+	return nil
+}
+
+type fakeCounters struct {
+	samples []server.CounterSample
+}
+
+func (f *fakeCounters) CounterSnapshot() []server.CounterSample { return f.samples }
+
+func mac(s string) net.HardwareAddr {
+	m, _ := net.ParseMAC(s)
+	return m
+}
+
+func TestGetLeases(t *testing.T) {
+	store := &fakeLeaseStore{leases: []leases.Lease{{Mac: mac("00:11:22:33:44:55"), Ip: net.IPv4(10, 0, 0, 5)}}}
+	srv := &Server{LeaseStore: store}
+	rr := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/leases", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+}
+
+func TestDeleteLeaseReleasesMatchingMac(t *testing.T) {
+	target := mac("00:11:22:33:44:55")
+	store := &fakeLeaseStore{leases: []leases.Lease{{Mac: target, Ip: net.IPv4(10, 0, 0, 5)}}}
+	srv := &Server{LeaseStore: store}
+	rr := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodDelete, "/leases/"+target.String(), nil))
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", rr.Code)
+	}
+	if len(store.released) != 1 || store.released[0] != target.String() {
+		t.Fatalf("expected %s to be released, got %v", target, store.released)
+	}
+}
+
+func TestDeleteLeaseUnknownMacNotFound(t *testing.T) {
+	store := &fakeLeaseStore{}
+	srv := &Server{LeaseStore: store}
+	rr := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodDelete, "/leases/00:11:22:33:44:55", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", rr.Code)
+	}
+}
+
+func TestReloadWithoutReloaderNotImplemented(t *testing.T) {
+	srv := &Server{}
+	rr := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/config/reload", nil))
+	if rr.Code != http.StatusNotImplemented {
+		t.Fatalf("expected 501, got %d", rr.Code)
+	}
+}
+
+func TestReloadCallsReloader(t *testing.T) {
+	reloader := &fakeReloader{}
+	srv := &Server{Reloader: reloader}
+	rr := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/config/reload", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	if !reloader.called {
+		t.Fatal("expected Reload to be called")
+	}
+}
+
+func TestMetricsRendersPrometheusFormat(t *testing.T) {
+	counters := &fakeCounters{samples: []server.CounterSample{
+		{Interface: "eth0", VLan: "100", MsgType: "DHCPDISCOVER", Count: 3},
+	}}
+	srv := &Server{Counters: counters}
+	rr := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rr.Body.String()
+	if !strings.Contains(body, `dhcp_packets_total{type="DHCPDISCOVER",interface="eth0",vlan="100"} 3`) {
+		t.Fatalf("unexpected metrics body: %s", body)
+	}
+}
@@ -0,0 +1,63 @@
+// +build linux
+
+package server
+
+import (
+	"io"
+	"net"
+	"syscall"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcap"
+)
+
+// PcapTransport is the production Transport: frames are read off a live
+// libpcap handle and replies are written through an AF_PACKET raw socket.
+type PcapTransport struct {
+	handle       *pcap.Handle
+	packetSource *gopacket.PacketSource
+	fd           int
+	addr         syscall.SockaddrLinklayer
+}
+
+// NewPcapTransport opens ifName for live capture, filtering to DHCP server
+// traffic, and opens the raw socket used to send replies back out on
+// ifIndex.
+func NewPcapTransport(ifName string, ifIndex int) (*PcapTransport, error) {
+	handle, err := pcap.OpenLive(ifName, 1600, true, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := handle.SetBPFFilter("(udp and dst port 67) or (vlan and udp and dst port 67)"); err != nil {
+		return nil, err
+	}
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, syscall.IPPROTO_RAW)
+	if err != nil {
+		return nil, err
+	}
+	return &PcapTransport{
+		handle:       handle,
+		packetSource: gopacket.NewPacketSource(handle, handle.LinkType()),
+		fd:           fd,
+		addr: syscall.SockaddrLinklayer{
+			Protocol: 4,
+			Halen:    6,
+			Pkttype:  0,
+			Ifindex:  ifIndex,
+		},
+	}, nil
+}
+
+func (t *PcapTransport) Recv() (gopacket.Packet, error) {
+	packet, ok := <-t.packetSource.Packets()
+	if !ok {
+		return nil, io.EOF
+	}
+	return packet, nil
+}
+
+func (t *PcapTransport) Send(payload []byte, dst net.HardwareAddr) error {
+	addr := t.addr
+	copy(addr.Addr[:], dst[0:8])
+	return syscall.Sendto(t.fd, payload, 0, &addr)
+}
@@ -2,32 +2,88 @@
 package server
 
 import (
+	"arpprobe"
 	"config"
 	"errors"
 	"fmt"
+	"leases"
 	"log"
 	"net"
 	"raw_packet"
-	"syscall"
+	"sync"
+	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
 	"github.com/krolaw/dhcp4"
 )
 
+// reapInterval is how often expired leases are swept out of the lease
+// store so the pool can be reused.
+const reapInterval = time.Minute
+
 type DhcpServer struct {
-	config       *config.ServerConfig
-	handle       *pcap.Handle
-	fd           int
-	packetSource *gopacket.PacketSource
-	ifIndex      int
-	addr         syscall.SockaddrLinklayer
-	resolver     Resolver
+	config     *config.ServerConfig
+	transport  Transport
+	ifIndex    int
+	resolverMu sync.RWMutex
+	resolver   Resolver
+	reloadFunc func() (Resolver, error)
+	leaseStore leases.LeaseStore
+	arpProber  ArpProber
+	counters   counters
+	routedSend func(giaddr net.IP, payload []byte) error
+}
+
+// ArpProber checks whether a candidate address is already in use on the
+// segment before it is offered (see package arpprobe).
+type ArpProber interface {
+	Probe(ip net.IP) (bool, error)
 }
 
 type Resolver interface {
 	Resolve(*DataPacket) *config.Lease
+	Release(*DataPacket)
+	Decline(*DataPacket)
+}
+
+// CounterSample is a snapshot of how many packets of one DHCP message
+// type have been seen on one interface/VLAN, for the management API's
+// GET /metrics (see package mgmt).
+type CounterSample struct {
+	Interface string
+	VLan      string
+	MsgType   string
+	Count     uint64
+}
+
+type counterKey struct {
+	msgType string
+	vlan    string
+}
+
+type counters struct {
+	mu     sync.Mutex
+	counts map[counterKey]uint64
+}
+
+func (c *counters) increment(msgType dhcp4.MessageType, vlan string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts == nil {
+		c.counts = make(map[counterKey]uint64)
+	}
+	c.counts[counterKey{msgType: msgType.String(), vlan: vlan}]++
+}
+
+func (c *counters) snapshot(iface string) []CounterSample {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	samples := make([]CounterSample, 0, len(c.counts))
+	for key, count := range c.counts {
+		samples = append(samples, CounterSample{Interface: iface, VLan: key.vlan, MsgType: key.msgType, Count: count})
+	}
+	return samples
 }
 
 func New(config *config.ServerConfig) *DhcpServer {
@@ -39,38 +95,130 @@ func New(config *config.ServerConfig) *DhcpServer {
 	return &server
 }
 
+// NewWithTransport builds a DhcpServer around a pre-built Transport
+// instead of discovering a live interface, so respond, processRequest,
+// and parsePacket can be exercised in tests without libpcap or root (see
+// package vnet's ChanTransport).
+func NewWithTransport(config *config.ServerConfig, transport Transport) *DhcpServer {
+	return &DhcpServer{config: config, transport: transport}
+}
+
 func (s *DhcpServer) SetResolver(resolver Resolver) *DhcpServer {
+	s.resolverMu.Lock()
 	s.resolver = resolver
+	s.resolverMu.Unlock()
+	return s
+}
+
+func (s *DhcpServer) currentResolver() Resolver {
+	s.resolverMu.RLock()
+	defer s.resolverMu.RUnlock()
+	return s.resolver
+}
+
+// SetReloadFunc registers the callback used by Reload (and so by the
+// management API's POST /config/reload, see package mgmt) to re-read
+// configuration and build the Resolver that replaces the active one.
+func (s *DhcpServer) SetReloadFunc(fn func() (Resolver, error)) *DhcpServer {
+	s.reloadFunc = fn
+	return s
+}
+
+// Reload re-reads configuration through the registered reload func and
+// atomically swaps in the new Resolver, without dropping the transport.
+func (s *DhcpServer) Reload() error {
+	if s.reloadFunc == nil {
+		return errors.New("no reload function configured")
+	}
+	resolver, err := s.reloadFunc()
+	if err != nil {
+		return err
+	}
+	s.SetResolver(resolver)
+	return nil
+}
+
+// SetLeaseStore attaches the store used to record allocations so the pool
+// survives restarts and can be reclaimed on expiry. If none is set,
+// allocations are not recorded anywhere.
+func (s *DhcpServer) SetLeaseStore(store leases.LeaseStore) *DhcpServer {
+	s.leaseStore = store
+	return s
+}
+
+// LeaseStore exposes the configured lease store so the management API
+// (see package mgmt) can list and release leases. May be nil.
+func (s *DhcpServer) LeaseStore() leases.LeaseStore {
+	return s.leaseStore
+}
+
+// CounterSnapshot reports per-message-type, per-VLAN packet counts for
+// the management API's GET /metrics (see package mgmt).
+func (s *DhcpServer) CounterSnapshot() []CounterSample {
+	return s.counters.snapshot(s.config.Listen)
+}
+
+// SetTransport overrides the packet transport. Run uses a PcapTransport by
+// default; tests set a ChanTransport here instead so respond,
+// processRequest, and parsePacket can be exercised without libpcap or a
+// real NIC.
+func (s *DhcpServer) SetTransport(transport Transport) *DhcpServer {
+	s.transport = transport
+	return s
+}
+
+// SetArpProber attaches the prober used to verify a candidate address is
+// free before it is offered. If none is set and the transport is a
+// PcapTransport, Run builds a default one; otherwise no probing is done.
+func (s *DhcpServer) SetArpProber(prober ArpProber) *DhcpServer {
+	s.arpProber = prober
+	return s
+}
+
+// SetRoutedSend overrides how a relayed reply (one addressed to a
+// giaddr) is sent, in place of the real routed UDP socket sendRouted
+// opens. Tests use this to assert the relayed-vs-direct branch in
+// respond without a real socket (see package vnet).
+func (s *DhcpServer) SetRoutedSend(send func(giaddr net.IP, payload []byte) error) *DhcpServer {
+	s.routedSend = send
 	return s
 }
 
 func (s *DhcpServer) Run() {
-	if s.resolver == nil {
+	if s.currentResolver() == nil {
 		log.Fatal("Resolver not set")
 	}
-	var err error
-	if s.handle, err = pcap.OpenLive(s.config.Listen, 1600, true, 0); err != nil {
-		log.Fatalf("Error opening live interface: %s", err)
-	} else if err := s.handle.SetBPFFilter("(udp and dst port 67) or (vlan and udp and dst port 67)"); err != nil {
-		log.Fatalf("Error setting BPF filter: %s", err)
-	} else {
-		s.fd, err = syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, syscall.IPPROTO_RAW)
+	if s.leaseStore != nil {
+		if err := s.leaseStore.Load(); err != nil {
+			log.Fatalf("Error loading lease store: %s", err)
+		}
+		go s.reapExpiredLeases()
+	}
+	if s.transport == nil {
+		transport, err := NewPcapTransport(s.config.Listen, s.ifIndex)
 		if err != nil {
-			log.Fatalf("Error opening raw socket: %s", err)
+			log.Fatalf("Error opening transport: %s", err)
+		}
+		s.transport = transport
+	}
+	if s.arpProber == nil {
+		if _, ok := s.transport.(*PcapTransport); ok {
+			prober, err := arpprobe.New(s.config.Listen, s.config.MyMac)
+			if err != nil {
+				log.Fatalf("Error opening ARP prober: %s", err)
+			}
+			s.arpProber = prober
 		}
-		s.packetSource = gopacket.NewPacketSource(s.handle, s.handle.LinkType())
-		s.run()
 	}
+	s.run()
 }
 
 func (s *DhcpServer) run() {
-	s.addr = syscall.SockaddrLinklayer{
-		Protocol: 4,
-		Halen:    6,
-		Pkttype:  0,
-		Ifindex:  s.ifIndex,
-	}
-	for packet := range s.packetSource.Packets() {
+	for {
+		packet, err := s.transport.Recv()
+		if err != nil {
+			log.Fatalf("Error receiving packet: %s", err)
+		}
 		p, err := s.parsePacket(packet)
 		if err != nil {
 			fmt.Printf("Error parsing incoming packet: %s", err)
@@ -87,17 +235,38 @@ func (s *DhcpServer) run() {
 	}
 }
 
+func (s *DhcpServer) reapExpiredLeases() {
+	ticker := time.NewTicker(reapInterval)
+	for range ticker.C {
+		for _, lease := range s.leaseStore.Expired(time.Now()) {
+			log.Printf("Lease expired: %s (%s)", lease.Ip, lease.Mac)
+		}
+		s.leaseStore.ReapConflicts(time.Now())
+		if err := s.leaseStore.Save(); err != nil {
+			log.Printf("Error saving lease store: %s", err)
+		}
+	}
+}
+
 func (s *DhcpServer) respond(p *DataPacket) {
+	s.counters.increment(p.Dhcp.MsgType, s.vlanList(p))
 	var response *raw_packet.RawPacket
 	switch p.Dhcp.MsgType {
 	case dhcp4.Request:
 		response = s.processRequest(p)
 	case dhcp4.Discover:
 		response = s.processDiscover(p)
+	case dhcp4.Release:
+		s.processRelease(p)
+	case dhcp4.Decline:
+		s.processDecline(p)
+	case dhcp4.Inform:
+		response = s.processInform(p)
 	default:
 		log.Printf("Request %s (%d) not yet implemented", p.Dhcp.MsgType, p.Dhcp.MsgType)
 	}
 	if response != nil {
+		s.counters.increment(response.DhcpType, s.vlanList(p))
 		log.Printf(
 			"%s to %s (vlan %s): %s",
 			response.DhcpType,
@@ -105,11 +274,12 @@ func (s *DhcpServer) respond(p *DataPacket) {
 			s.vlanList(p),
 			response.OfferedIp,
 		)
-		addr := s.addr
-		copy(addr.Addr[:], p.DstMac[0:8])
-		err := syscall.Sendto(s.fd, response.Marshal(), 0, &addr)
-		if err != nil {
-			log.Fatalf("Sendto failed: %s", err)
+		if p.Dhcp.GIAddr != nil && !p.Dhcp.GIAddr.Equal(net.IPv4zero) {
+			if err := s.sendToRelay(p.Dhcp.GIAddr, response.Payload); err != nil {
+				log.Fatalf("Routed send to relay %s failed: %s", p.Dhcp.GIAddr, err)
+			}
+		} else if err := s.transport.Send(response.Marshal(), response.DstMac); err != nil {
+			log.Fatalf("Send failed: %s", err)
 		}
 	} else {
 		log.Printf(
@@ -120,13 +290,42 @@ func (s *DhcpServer) respond(p *DataPacket) {
 	}
 }
 
+// sendToRelay sends a DHCP reply addressed to giaddr, via routedSend if
+// a test has overridden it (SetRoutedSend), otherwise via sendRouted's
+// real routed UDP socket.
+func (s *DhcpServer) sendToRelay(giaddr net.IP, payload []byte) error {
+	if s.routedSend != nil {
+		return s.routedSend(giaddr, payload)
+	}
+	return s.sendRouted(giaddr, payload)
+}
+
+// sendRouted unicasts a DHCP reply to a relay agent's giaddr:67 over a
+// routed UDP socket. It is used instead of the L2 Transport whenever
+// giaddr is set (RFC 3046): the relay may be more than one hop away, so
+// there is no single next-hop MAC to address an Ethernet frame to.
+func (s *DhcpServer) sendRouted(giaddr net.IP, payload []byte) error {
+	conn, err := net.DialUDP("udp4", &net.UDPAddr{Port: 67}, &net.UDPAddr{IP: giaddr, Port: 67})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write(payload)
+	return err
+}
+
 func (s *DhcpServer) processRequest(p *DataPacket) *raw_packet.RawPacket {
-	if lease := s.resolver.Resolve(p); lease != nil {
+	if lease := s.currentResolver().Resolve(p); lease != nil {
 		if p.Dhcp.packet.CIAddr() == nil {
 			return s.prepareOffer(p, lease)
 		} else if lease.Ip.Equal(p.Dhcp.packet.CIAddr()) {
+			s.renewLease(p, lease)
 			return s.prepareAck(p, lease)
 		} else if lease.Ip.Equal(p.Dhcp.RequestedIp) {
+			if err := s.allocateLease(p, lease); err != nil {
+				log.Printf("NAK: %s already leased to another client: %s", lease.Ip, err)
+				return s.prepareNak(p, lease)
+			}
 			return s.prepareAck(p, lease)
 		}
 		log.Printf("NAK: client wants %s, got %s", p.Dhcp.RequestedIp, lease.Ip)
@@ -135,9 +334,104 @@ func (s *DhcpServer) processRequest(p *DataPacket) *raw_packet.RawPacket {
 	return nil
 }
 
+// allocateLease records a freshly committed lease in the lease store, if
+// one is configured. It returns the store's error unchanged so the
+// caller can NAK instead of acknowledging an address already leased to
+// another client.
+func (s *DhcpServer) allocateLease(p *DataPacket, lease *config.Lease) error {
+	if s.leaseStore == nil {
+		return nil
+	}
+	_, err := s.leaseStore.Allocate(p.SrcMac, lease.Ip, p.VLan)
+	return err
+}
+
+// renewLease extends a client's existing lease in the lease store, if one
+// is configured.
+func (s *DhcpServer) renewLease(p *DataPacket, lease *config.Lease) {
+	if s.leaseStore == nil {
+		return
+	}
+	if err := s.leaseStore.Renew(p.SrcMac, lease.Ip); err != nil {
+		log.Printf("Error renewing lease for %s: %s", p.SrcMac, err)
+	}
+}
+
+// maxArpProbeAttempts bounds how many addresses processDiscover will probe
+// (the first candidate included) before giving up, so a pool that is mostly
+// conflicted can't turn one DISCOVER into an unbounded probe loop.
+const maxArpProbeAttempts = 3
+
 func (s *DhcpServer) processDiscover(p *DataPacket) *raw_packet.RawPacket {
-	if lease := s.resolver.Resolve(p); lease != nil {
-		return s.prepareOffer(p, lease)
+	lease := s.currentResolver().Resolve(p)
+	for attempt := 0; attempt < maxArpProbeAttempts; attempt++ {
+		if lease == nil {
+			return nil
+		}
+		if s.leaseIsConflicted(lease.Ip) {
+			log.Printf("Not offering %s: address is quarantined after a conflict", lease.Ip)
+			return nil
+		}
+		if s.arpProber == nil {
+			return s.prepareOffer(p, lease)
+		}
+		inUse, err := s.arpProber.Probe(lease.Ip)
+		if err != nil {
+			log.Printf("ARP probe for %s failed: %s", lease.Ip, err)
+			return s.prepareOffer(p, lease)
+		}
+		if !inUse {
+			return s.prepareOffer(p, lease)
+		}
+		log.Printf("ARP probe found %s already in use, quarantining and asking for an alternate", lease.Ip)
+		if s.leaseStore != nil {
+			s.leaseStore.Conflict(lease.Ip, leases.ConflictQuarantine)
+		}
+		lease = s.currentResolver().Resolve(p)
+	}
+	log.Printf("Giving up on %s for %s: %d consecutive addresses were already in use", p.SrcMac, s.vlanList(p), maxArpProbeAttempts)
+	return nil
+}
+
+// leaseIsConflicted reports whether ip is currently withheld by a prior
+// DECLINE or failed ARP probe, per the lease store's quarantine.
+func (s *DhcpServer) leaseIsConflicted(ip net.IP) bool {
+	return s.leaseStore != nil && s.leaseStore.IsConflicted(ip)
+}
+
+// processRelease handles a DHCPRELEASE sent by a client that is shutting
+// down or giving up its lease early. Per RFC 2131 section 4.3.5 the server
+// does not send a reply.
+func (s *DhcpServer) processRelease(p *DataPacket) {
+	s.currentResolver().Release(p)
+	if s.leaseStore != nil {
+		if err := s.leaseStore.Release(p.SrcMac, p.Dhcp.packet.CIAddr()); err != nil {
+			log.Printf("Error releasing lease for %s: %s", p.SrcMac, err)
+		}
+	}
+}
+
+// processDecline handles a DHCPDECLINE sent when a client's ARP probe
+// (RFC 5227) finds the offered address already in use. The resolver is
+// told through Decline, and the address is quarantined in the lease store
+// (if one is set) so it is not offered again for a while; no reply is
+// sent, as per RFC 2131 section 4.3.5.
+func (s *DhcpServer) processDecline(p *DataPacket) {
+	s.currentResolver().Decline(p)
+	if s.leaseStore != nil && p.Dhcp.RequestedIp != nil {
+		s.leaseStore.Conflict(p.Dhcp.RequestedIp, leases.ConflictQuarantine)
+		if err := s.leaseStore.Release(p.SrcMac, p.Dhcp.RequestedIp); err != nil {
+			log.Printf("Error releasing declined lease for %s: %s", p.SrcMac, err)
+		}
+	}
+}
+
+// processInform handles a DHCPINFORM sent by a client that configured its
+// own address but still wants server-provided options such as DNS or
+// domain name.
+func (s *DhcpServer) processInform(p *DataPacket) *raw_packet.RawPacket {
+	if lease := s.currentResolver().Resolve(p); lease != nil {
+		return s.prepareInformAck(p, lease)
 	}
 	return nil
 }
@@ -174,6 +468,25 @@ func (s *DhcpServer) prepareAck(p *DataPacket, lease *config.Lease) *raw_packet.
 	return responsePacket
 }
 
+// prepareInformAck builds the DHCPACK reply to a DHCPINFORM. Unlike a
+// regular ACK it carries only option fields: per RFC 2131 section 4.3.5
+// yiaddr and the lease time options must be left out, since the client
+// already owns the address.
+func (s *DhcpServer) prepareInformAck(p *DataPacket, lease *config.Lease) *raw_packet.RawPacket {
+	resp := p.InformAckResponse(lease, s)
+	responsePacket := &raw_packet.RawPacket{
+		DhcpType:  dhcp4.ACK,
+		EtherType: p.EtherType,
+		VLan:      p.VLan,
+		Payload:   []byte(*resp),
+		SrcIp:     s.config.MyAddress,
+		DstIp:     p.SrcIP,
+		DstMac:    p.SrcMac,
+		SrcMac:    s.config.MyMac,
+	}
+	return responsePacket
+}
+
 func (s *DhcpServer) prepareNak(p *DataPacket, lease *config.Lease) *raw_packet.RawPacket {
 	resp := p.NakResponse(lease, s)
 	responsePacket := &raw_packet.RawPacket{
@@ -231,5 +544,31 @@ func (s *DhcpServer) parsePacket(p gopacket.Packet) (*DataPacket, error) {
 			dp.Dhcp.RequestedIp = net.IPv4(requestedIp[0], requestedIp[1], requestedIp[2], requestedIp[3])
 		}
 	}
+	if giaddr := dp.Dhcp.packet.GIAddr(); giaddr != nil && !giaddr.Equal(net.IPv4zero) {
+		dp.Dhcp.GIAddr = giaddr
+	}
+	if relayInfo, ok := dp.Dhcp.Options[dhcp4.OptionCode(82)]; ok {
+		dp.Dhcp.CircuitID, dp.Dhcp.RemoteID = parseRelayAgentInfo(relayInfo)
+	}
 	return dp, nil
 }
+
+// parseRelayAgentInfo splits an Option 82 (RFC 3046) value into its
+// Circuit ID (sub-option 1) and Remote ID (sub-option 2).
+func parseRelayAgentInfo(data []byte) (circuitID, remoteID []byte) {
+	for len(data) >= 2 {
+		subOpt, length := data[0], int(data[1])
+		if length > len(data)-2 {
+			break
+		}
+		value := data[2 : 2+length]
+		switch subOpt {
+		case 1:
+			circuitID = value
+		case 2:
+			remoteID = value
+		}
+		data = data[2+length:]
+	}
+	return circuitID, remoteID
+}
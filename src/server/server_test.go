@@ -0,0 +1,217 @@
+package server
+
+import (
+	"config"
+	"net"
+	"testing"
+	"time"
+
+	"vnet"
+
+	"leases"
+
+	"github.com/krolaw/dhcp4"
+)
+
+type fakeResolver struct {
+	lease *config.Lease
+}
+
+func (f *fakeResolver) Resolve(*DataPacket) *config.Lease { return f.lease }
+func (f *fakeResolver) Release(*DataPacket)                {}
+func (f *fakeResolver) Decline(*DataPacket)                {}
+
+func newTestServer(t *testing.T, resolver Resolver) (*DhcpServer, *vnet.ChanTransport) {
+	t.Helper()
+	transport := vnet.NewChanTransport()
+	srv := NewWithTransport(&config.ServerConfig{
+		MyAddress: net.IPv4(10, 0, 0, 1),
+		MyMac:     net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01},
+	}, transport)
+	srv.SetResolver(resolver)
+	return srv, transport
+}
+
+func TestRespondOffersOnDiscover(t *testing.T) {
+	clientMac := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0x00, 0x00, 0x01}
+	resolver := &fakeResolver{lease: &config.Lease{Ip: net.IPv4(10, 0, 0, 50)}}
+	srv, transport := newTestServer(t, resolver)
+
+	frame := vnet.BuildDhcp(dhcp4.Discover, vnet.FrameOpts{SrcMac: clientMac})
+	transport.Inject(frame)
+	packet, err := transport.Recv()
+	if err != nil {
+		t.Fatalf("Recv: %s", err)
+	}
+	p, err := srv.parsePacket(packet)
+	if err != nil {
+		t.Fatalf("parsePacket: %s", err)
+	}
+	if p.Dhcp.MsgType != dhcp4.Discover {
+		t.Fatalf("expected Discover, got %s", p.Dhcp.MsgType)
+	}
+
+	done := make(chan vnet.Frame, 1)
+	go func() { done <- transport.Sent() }()
+	srv.respond(p)
+
+	select {
+	case reply := <-done:
+		if reply.Dst.String() != clientMac.String() {
+			t.Fatalf("expected reply to %s, got %s", clientMac, reply.Dst)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("server did not send an OFFER")
+	}
+}
+
+func TestParsePacketVlanTaggedDiscover(t *testing.T) {
+	clientMac := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0x00, 0x00, 0x02}
+	resolver := &fakeResolver{lease: &config.Lease{Ip: net.IPv4(10, 0, 0, 51)}}
+	srv, transport := newTestServer(t, resolver)
+
+	frame := vnet.BuildDhcp(dhcp4.Discover, vnet.FrameOpts{SrcMac: clientMac, VLan: 100})
+	transport.Inject(frame)
+	packet, _ := transport.Recv()
+	p, err := srv.parsePacket(packet)
+	if err != nil {
+		t.Fatalf("parsePacket: %s", err)
+	}
+	if len(p.VLan) != 1 || p.VLan[0] != 100 {
+		t.Fatalf("expected VLAN 100, got %v", p.VLan)
+	}
+}
+
+func TestRespondReleaseSendsNoReply(t *testing.T) {
+	clientMac := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0x00, 0x00, 0x03}
+	resolver := &fakeResolver{lease: &config.Lease{Ip: net.IPv4(10, 0, 0, 52)}}
+	srv, transport := newTestServer(t, resolver)
+
+	frame := vnet.BuildDhcp(dhcp4.Release, vnet.FrameOpts{SrcMac: clientMac, CiAddr: net.IPv4(10, 0, 0, 52)})
+	transport.Inject(frame)
+	packet, _ := transport.Recv()
+	p, err := srv.parsePacket(packet)
+	if err != nil {
+		t.Fatalf("parsePacket: %s", err)
+	}
+	srv.respond(p)
+
+	select {
+	case <-time.After(50 * time.Millisecond):
+	case reply := <-sentOrNil(transport):
+		t.Fatalf("expected no reply to RELEASE, got one addressed to %s", reply.Dst)
+	}
+}
+
+func TestRespondDoesNotOfferConflictedAddress(t *testing.T) {
+	clientMac := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0x00, 0x00, 0x06}
+	ip := net.IPv4(10, 0, 0, 60)
+	resolver := &fakeResolver{lease: &config.Lease{Ip: ip}}
+	srv, transport := newTestServer(t, resolver)
+	store := leases.NewMemoryStore()
+	store.Conflict(ip, time.Minute)
+	srv.SetLeaseStore(store)
+
+	frame := vnet.BuildDhcp(dhcp4.Discover, vnet.FrameOpts{SrcMac: clientMac})
+	transport.Inject(frame)
+	packet, _ := transport.Recv()
+	p, err := srv.parsePacket(packet)
+	if err != nil {
+		t.Fatalf("parsePacket: %s", err)
+	}
+	srv.respond(p)
+
+	select {
+	case <-time.After(50 * time.Millisecond):
+	case reply := <-sentOrNil(transport):
+		t.Fatalf("expected no offer for a conflicted address, got one addressed to %s", reply.Dst)
+	}
+}
+
+func TestRespondRoutesGIAddrFramesToRelay(t *testing.T) {
+	clientMac := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0x00, 0x00, 0x05}
+	resolver := &fakeResolver{lease: &config.Lease{Ip: net.IPv4(10, 0, 0, 54)}}
+	srv, transport := newTestServer(t, resolver)
+
+	var gotGiaddr net.IP
+	var gotPayload []byte
+	srv.SetRoutedSend(func(giaddr net.IP, payload []byte) error {
+		gotGiaddr = giaddr
+		gotPayload = payload
+		return nil
+	})
+
+	frame := vnet.BuildDhcp(dhcp4.Discover, vnet.FrameOpts{
+		SrcMac: clientMac,
+		GiAddr: net.IPv4(10, 1, 1, 1),
+	})
+	transport.Inject(frame)
+	packet, _ := transport.Recv()
+	p, err := srv.parsePacket(packet)
+	if err != nil {
+		t.Fatalf("parsePacket: %s", err)
+	}
+	srv.respond(p)
+
+	if gotGiaddr == nil || !gotGiaddr.Equal(net.IPv4(10, 1, 1, 1)) {
+		t.Fatalf("expected routed send to giaddr 10.1.1.1, got %v", gotGiaddr)
+	}
+	if len(gotPayload) == 0 {
+		t.Fatal("expected a non-empty DHCP reply payload routed to the relay")
+	}
+
+	select {
+	case reply := <-sentOrNil(transport):
+		t.Fatalf("expected no direct L2 send for a relayed reply, got one addressed to %s", reply.Dst)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func sentOrNil(t *vnet.ChanTransport) <-chan vnet.Frame {
+	ch := make(chan vnet.Frame, 1)
+	go func() { ch <- t.Sent() }()
+	return ch
+}
+
+func TestParseRelayAgentInfo(t *testing.T) {
+	cases := []struct {
+		name               string
+		data               []byte
+		circuitID, remoteID string
+	}{
+		{"circuit and remote", []byte{1, 2, 'e', '1', 2, 3, 'b', 'n', 'g'}, "e1", "bng"},
+		{"circuit only", []byte{1, 1, 'x'}, "x", ""},
+		{"empty", nil, "", ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			circuitID, remoteID := parseRelayAgentInfo(c.data)
+			if string(circuitID) != c.circuitID {
+				t.Errorf("circuitID = %q, want %q", circuitID, c.circuitID)
+			}
+			if string(remoteID) != c.remoteID {
+				t.Errorf("remoteID = %q, want %q", remoteID, c.remoteID)
+			}
+		})
+	}
+}
+
+func TestParsePacketParsesGIAddr(t *testing.T) {
+	clientMac := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0x00, 0x00, 0x04}
+	resolver := &fakeResolver{lease: &config.Lease{Ip: net.IPv4(10, 0, 0, 53)}}
+	srv, transport := newTestServer(t, resolver)
+
+	frame := vnet.BuildDhcp(dhcp4.Discover, vnet.FrameOpts{
+		SrcMac: clientMac,
+		GiAddr: net.IPv4(10, 1, 1, 1),
+	})
+	transport.Inject(frame)
+	packet, _ := transport.Recv()
+	p, err := srv.parsePacket(packet)
+	if err != nil {
+		t.Fatalf("parsePacket: %s", err)
+	}
+	if p.Dhcp.GIAddr == nil || !p.Dhcp.GIAddr.Equal(net.IPv4(10, 1, 1, 1)) {
+		t.Fatalf("expected GIAddr 10.1.1.1, got %v", p.Dhcp.GIAddr)
+	}
+}
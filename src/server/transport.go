@@ -0,0 +1,16 @@
+package server
+
+import (
+	"net"
+
+	"github.com/google/gopacket"
+)
+
+// Transport abstracts the physical packet I/O so respond, processRequest,
+// and parsePacket can be exercised without libpcap or a real NIC.
+// PcapTransport is the production implementation; package vnet provides a
+// ChanTransport for tests.
+type Transport interface {
+	Recv() (gopacket.Packet, error)
+	Send(payload []byte, dst net.HardwareAddr) error
+}
@@ -0,0 +1,83 @@
+package vnet
+
+import (
+	"net"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/krolaw/dhcp4"
+)
+
+// FrameOpts customizes a client frame synthesized by BuildDhcp.
+type FrameOpts struct {
+	SrcMac      net.HardwareAddr
+	VLan        uint16 // 0 means untagged
+	RequestedIp net.IP
+	CiAddr      net.IP
+	GiAddr      net.IP // non-zero simulates a relayed request; Option 82 is added only from CircuitID/RemoteID
+	CircuitID   []byte
+	RemoteID    []byte
+}
+
+// BuildDhcp serializes an Ethernet/[Dot1Q]/IPv4/UDP/DHCP frame carrying a
+// single DHCP message of the given type, ready for ChanTransport.Inject.
+func BuildDhcp(msgType dhcp4.MessageType, opts FrameOpts) []byte {
+	var options []dhcp4.Option
+	if opts.RequestedIp != nil {
+		options = append(options, dhcp4.Option{Code: dhcp4.OptionRequestedIPAddress, Value: opts.RequestedIp.To4()})
+	}
+	if len(opts.CircuitID) > 0 || len(opts.RemoteID) > 0 {
+		options = append(options, dhcp4.Option{Code: dhcp4.OptionCode(82), Value: relayAgentInfo(opts.CircuitID, opts.RemoteID)})
+	}
+	ciAddr := opts.CiAddr
+	if ciAddr == nil {
+		ciAddr = net.IPv4zero
+	}
+	giAddr := opts.GiAddr
+	if giAddr == nil {
+		giAddr = net.IPv4zero
+	}
+	dhcpPacket := dhcp4.RequestPacket(msgType, opts.SrcMac, ciAddr, []byte{1, 2, 3, 4}, false, options)
+	dhcpPacket.SetGIAddr(giAddr)
+
+	eth := &layers.Ethernet{
+		SrcMAC:       opts.SrcMac,
+		DstMAC:       net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		SrcIP:    net.IPv4zero,
+		DstIP:    net.IPv4bcast,
+		Protocol: layers.IPProtocolUDP,
+	}
+	udp := &layers.UDP{SrcPort: 68, DstPort: 67}
+	udp.SetNetworkLayerForChecksum(ip)
+
+	buf := gopacket.NewSerializeBuffer()
+	serializeOpts := gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true}
+	if opts.VLan != 0 {
+		eth.EthernetType = layers.EthernetTypeDot1Q
+		dot1q := &layers.Dot1Q{VLANIdentifier: opts.VLan, Type: layers.EthernetTypeIPv4}
+		gopacket.SerializeLayers(buf, serializeOpts, eth, dot1q, ip, udp, gopacket.Payload(dhcpPacket))
+	} else {
+		gopacket.SerializeLayers(buf, serializeOpts, eth, ip, udp, gopacket.Payload(dhcpPacket))
+	}
+	return buf.Bytes()
+}
+
+// relayAgentInfo encodes DHCP option 82 (RFC 3046) sub-options 1 (Circuit
+// ID) and 2 (Remote ID).
+func relayAgentInfo(circuitID, remoteID []byte) []byte {
+	var b []byte
+	if len(circuitID) > 0 {
+		b = append(b, 1, byte(len(circuitID)))
+		b = append(b, circuitID...)
+	}
+	if len(remoteID) > 0 {
+		b = append(b, 2, byte(len(remoteID)))
+		b = append(b, remoteID...)
+	}
+	return b
+}
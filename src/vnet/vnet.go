@@ -0,0 +1,61 @@
+// Package vnet is a small virtual network transport for tests, in the
+// spirit of Tailscale's tstest/natlab/vnet: it ships Ethernet frames over
+// Go channels instead of a NIC, so server.DhcpServer can be driven
+// deterministically with crafted DISCOVER/REQUEST/RELEASE frames, without
+// CGO, libpcap, or root.
+package vnet
+
+import (
+	"io"
+	"net"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Frame is a reply captured from the server under test: the raw bytes it
+// wrote and the destination MAC it addressed them to.
+type Frame struct {
+	Payload []byte
+	Dst     net.HardwareAddr
+}
+
+// ChanTransport implements server.Transport over channels, standing in
+// for a PcapTransport in tests.
+type ChanTransport struct {
+	in  chan gopacket.Packet
+	out chan Frame
+}
+
+// NewChanTransport returns a ChanTransport ready to Inject frames into and
+// read Sent frames back out of.
+func NewChanTransport() *ChanTransport {
+	return &ChanTransport{
+		in:  make(chan gopacket.Packet, 16),
+		out: make(chan Frame, 16),
+	}
+}
+
+func (t *ChanTransport) Recv() (gopacket.Packet, error) {
+	packet, ok := <-t.in
+	if !ok {
+		return nil, io.EOF
+	}
+	return packet, nil
+}
+
+func (t *ChanTransport) Send(payload []byte, dst net.HardwareAddr) error {
+	t.out <- Frame{Payload: append([]byte(nil), payload...), Dst: dst}
+	return nil
+}
+
+// Inject decodes a raw Ethernet frame (as built by BuildDhcp) and delivers
+// it to the server as if it had just been captured off the wire.
+func (t *ChanTransport) Inject(frame []byte) {
+	t.in <- gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+}
+
+// Sent blocks until the server under test writes its next reply frame.
+func (t *ChanTransport) Sent() Frame {
+	return <-t.out
+}